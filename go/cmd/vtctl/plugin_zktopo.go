@@ -10,6 +10,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"path"
 	"sort"
 	"sync"
@@ -19,32 +20,60 @@ import (
 	"code.google.com/p/vitess/go/sync2"
 	"code.google.com/p/vitess/go/vt/naming"
 	tm "code.google.com/p/vitess/go/vt/tabletmanager"
+	"code.google.com/p/vitess/go/vt/tabletmanager/actionfmt"
 	wr "code.google.com/p/vitess/go/vt/wrangler"
 	"code.google.com/p/vitess/go/vt/zktopo"
+	"code.google.com/p/vitess/go/vt/zktopo/actionmetrics"
 	"code.google.com/p/vitess/go/zk"
+	"golang.org/x/net/context"
 	"launchpad.net/gozk/zookeeper"
 )
 
+// defaultMaxConcurrency bounds the number of in-flight ZK RPCs for the
+// fan-out commands below when -max-concurrency isn't given.
+const defaultMaxConcurrency = 20
+
+// acquire blocks until sem has room or ctx is done, whichever comes first.
+func acquire(ctx context.Context, sem chan struct{}) error {
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func init() {
 	addCommand("Generic", command{
 		"PurgeActions",
 		commandPurgeActions,
-		"<zk action path> ... (/zk/global/vt/keyspaces/<keyspace>/shards/<shard>/action)",
+		"[-force] [-dry-run] <zk action path> ... (/zk/global/vt/keyspaces/<keyspace>/shards/<shard>/action)",
 		"(requires Zookeeper TopologyServer)\n" +
-			"Remove all actions - be careful, this is powerful cleanup magic."})
+			"Remove all actions - be careful, this is powerful cleanup magic.\n" +
+			"Deletes are version-checked against the listed znode unless -force is given.\n" +
+			"With -dry-run, print what would be purged instead of purging it."})
 	addCommand("Generic", command{
 		"StaleActions",
 		commandStaleActions,
-		"[-max-staleness=<duration> -purge] <zk action path> ... (/zk/global/vt/keyspaces/<keyspace>/shards/<shard>/action)",
+		"[-max-staleness=<duration> -purge [-force] [-dry-run]] [-format=text|json] <zk action path> ... (/zk/global/vt/keyspaces/<keyspace>/shards/<shard>/action)",
 		"(requires Zookeeper TopologyServer)\n" +
 			"List any queued actions that are considered stale."})
 	addCommand("Generic", command{
 		"PruneActionLogs",
 		commandPruneActionLogs,
-		"[-keep-count=<count to keep>] <zk actionlog path> ...",
+		"[-keep-count=<count to keep>] [-force] [-dry-run] <zk actionlog path> ...",
 		"(requires Zookeeper TopologyServer)\n" +
 			"e.g. PruneActionLogs -keep-count=10 /zk/global/vt/keyspaces/my_keyspace/shards/0/actionlog\n" +
-			"Removes older actionlog entries until at most <count to keep> are left."})
+			"Removes older actionlog entries until at most <count to keep> are left.\n" +
+			"Deletes are version-checked against the listed znode unless -force is given."})
+	addCommand("Generic", command{
+		"ExportActionMetrics",
+		commandExportActionMetrics,
+		"[-addr=<host:port>] [-stale-threshold=<duration>] [-max-concurrency=<n>] <keyspace/shard> ...",
+		"(requires Zookeeper TopologyServer)\n" +
+			"Export action queue health (pending count, oldest age, stale count, actionlog length,\n" +
+			"per-action-type latency) as Prometheus metrics for the given shards.\n" +
+			"With -addr, serve /metrics forever; otherwise dump once to stdout and exit."})
 	addCommand("Generic", command{
 		"ExportZkns",
 		commandExportZkns,
@@ -61,7 +90,7 @@ func init() {
 	addCommand("Shards", command{
 		"ListShardActions",
 		commandListShardActions,
-		"<keyspace/shard|zk shard path>",
+		"[-format=text|json] <keyspace/shard|zk shard path>",
 		"(requires Zookeeper TopologyServer)\n" +
 			"List all active actions in a given shard."})
 
@@ -76,7 +105,63 @@ func zkResolveWildcards(wrangler *wr.Wrangler, args []string) ([]string, error)
 	return zk.ResolveWildcards(zkts.GetZConn(), args)
 }
 
+// actionNodesByPath sorts ActionNode slices by their znode path, which for
+// sequential ZK nodes also sorts them chronologically (oldest first).
+type actionNodesByPath []*tm.ActionNode
+
+func (a actionNodesByPath) Len() int           { return len(a) }
+func (a actionNodesByPath) Less(i, j int) bool { return a[i].Path() < a[j].Path() }
+func (a actionNodesByPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// previewPurge reports, without deleting anything, which actions under
+// actionPath would be removed by a real PurgeActions call. It uses its own
+// semaphore for the node reads it issues, independent of any semaphore the
+// caller is holding a slot in, to avoid a self-deadlock.
+func previewPurge(ctx context.Context, zconn zk.Conn, actionPath string) (int, error) {
+	nodes, err := getActions(ctx, zconn, actionPath, make(chan struct{}, defaultMaxConcurrency))
+	if err != nil {
+		return 0, err
+	}
+	var toPurge []*tm.ActionNode
+	for _, node := range nodes {
+		if tm.ActionNodeCanBePurged(node) {
+			toPurge = append(toPurge, node)
+		}
+	}
+	if err := actionfmt.FormatActions(os.Stdout, toPurge, actionfmt.Text); err != nil {
+		return 0, err
+	}
+	fmt.Printf("%v: %v of %v actions would be purged\n", actionPath, len(toPurge), len(nodes))
+	return len(toPurge), nil
+}
+
+// previewPrune reports, without deleting anything, which actionlog entries
+// under actionLogPath would be removed by a real PruneActionLogs call: the
+// oldest entries beyond keepCount. Like previewPurge, it uses its own
+// semaphore for node reads.
+func previewPrune(ctx context.Context, zconn zk.Conn, actionLogPath string, keepCount int) (int, error) {
+	nodes, err := getActions(ctx, zconn, actionLogPath, make(chan struct{}, defaultMaxConcurrency))
+	if err != nil {
+		return 0, err
+	}
+	sort.Sort(actionNodesByPath(nodes))
+	if len(nodes) <= keepCount {
+		fmt.Printf("%v: %v entries, keep-count=%v, nothing would be pruned\n", actionLogPath, len(nodes), keepCount)
+		return 0, nil
+	}
+	toPrune := nodes[:len(nodes)-keepCount]
+	if err := actionfmt.FormatActions(os.Stdout, toPrune, actionfmt.Text); err != nil {
+		return 0, err
+	}
+	fmt.Printf("%v: %v of %v entries would be pruned\n", actionLogPath, len(toPrune), len(nodes))
+	return len(toPrune), nil
+}
+
 func commandPurgeActions(wrangler *wr.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	timeout := subFlags.Duration("timeout", 0, "abort remaining work if it isn't done within this long (0 = no timeout)")
+	maxConcurrency := subFlags.Int("max-concurrency", defaultMaxConcurrency, "maximum number of action paths to purge concurrently")
+	force := subFlags.Bool("force", false, "skip the version check and delete unconditionally, even if an action was updated since it was listed")
+	dryRun := subFlags.Bool("dry-run", false, "print what would be purged, per path, without deleting anything")
 	subFlags.Parse(args)
 	if subFlags.NArg() == 0 {
 		relog.Fatal("action PurgeActions requires <zk action path> ...")
@@ -89,38 +174,55 @@ func commandPurgeActions(wrangler *wr.Wrangler, subFlags *flag.FlagSet, args []s
 	if err != nil {
 		return "", err
 	}
-	for _, zkActionPath := range zkActionPaths {
-		err := zkts.PurgeActions(zkActionPath, tm.ActionNodeCanBePurged)
-		if err != nil {
-			return "", err
-		}
-	}
-	return "", nil
-}
 
-func staleActions(zkts *zktopo.ZkTopologyServer, zkActionPath string, maxStaleness time.Duration) ([]*tm.ActionNode, error) {
-	// get the stale strings
-	actionNodes, err := zkts.StaleActions(zkActionPath, maxStaleness, tm.ActionNodeIsStale)
-	if err != nil {
-		return nil, err
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
 	}
 
-	// convert to ActionNode
-	staleActions := make([]*tm.ActionNode, len(actionNodes))
-	for i, actionNodeStr := range actionNodes {
-		actionNode, err := tm.ActionNodeFromJson(actionNodeStr, "")
-		if err != nil {
-			return nil, err
-		}
-		staleActions[i] = actionNode
+	sem := make(chan struct{}, *maxConcurrency)
+	var errCount sync2.AtomicInt32
+	wg := sync.WaitGroup{}
+	for _, apath := range zkActionPaths {
+		wg.Add(1)
+		go func(zkActionPath string) {
+			defer wg.Done()
+			if err := acquire(ctx, sem); err != nil {
+				errCount.Add(1)
+				relog.Error("can't purge actions: %v %v", zkActionPath, err)
+				return
+			}
+			defer func() { <-sem }()
+			if *dryRun {
+				if _, err := previewPurge(ctx, zkts.GetZConn(), zkActionPath); err != nil {
+					errCount.Add(1)
+					relog.Error("can't preview purge: %v %v", zkActionPath, err)
+				}
+				return
+			}
+			if err := zkts.PurgeActions(ctx, zkActionPath, tm.ActionNodeCanBePurged, *force); err != nil {
+				errCount.Add(1)
+				relog.Error("can't purge actions: %v %v", zkActionPath, err)
+			}
+		}(apath)
 	}
-
-	return staleActions, nil
+	wg.Wait()
+	if errCount.Get() > 0 {
+		return "", fmt.Errorf("some errors occurred, check the log")
+	}
+	return "", nil
 }
 
 func commandStaleActions(wrangler *wr.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
 	maxStaleness := subFlags.Duration("max-staleness", 5*time.Minute, "how long since the last modification before an action considered stale")
 	purge := subFlags.Bool("purge", false, "purge stale actions")
+	force := subFlags.Bool("force", false, "when purging, skip the version check and delete unconditionally")
+	dryRun := subFlags.Bool("dry-run", false, "with -purge, print what would be purged instead of purging it")
+	timeout := subFlags.Duration("timeout", 0, "abort remaining work if it isn't done within this long (0 = no timeout)")
+	maxConcurrency := subFlags.Int("max-concurrency", defaultMaxConcurrency, "maximum number of action paths to check concurrently")
+	format := subFlags.String("format", actionfmt.Text, "output format: text or json")
 	subFlags.Parse(args)
 	if subFlags.NArg() == 0 {
 		relog.Fatal("action StaleActions requires <zk action path>")
@@ -133,23 +235,60 @@ func commandStaleActions(wrangler *wr.Wrangler, subFlags *flag.FlagSet, args []s
 	if err != nil {
 		return "", err
 	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	sem := make(chan struct{}, *maxConcurrency)
 	var errCount sync2.AtomicInt32
+	var stdout sync.Mutex
 	wg := sync.WaitGroup{}
 	for _, apath := range zkPaths {
 		wg.Add(1)
 		go func(zkActionPath string) {
 			defer wg.Done()
-			staleActions, err := staleActions(zkts, zkActionPath, *maxStaleness)
+			if err := acquire(ctx, sem); err != nil {
+				errCount.Add(1)
+				relog.Error("can't check stale actions: %v %v", zkActionPath, err)
+				return
+			}
+			defer func() { <-sem }()
+			staleActions, err := zkts.StaleActions(ctx, zkActionPath, *maxStaleness, tm.ActionNodeIsStale)
 			if err != nil {
 				errCount.Add(1)
 				relog.Error("can't check stale actions: %v %v", zkActionPath, err)
 				return
 			}
-			for _, action := range staleActions {
-				fmt.Println(fmtAction(action))
+			stdout.Lock()
+			err = actionfmt.FormatActions(os.Stdout, staleActions, *format)
+			stdout.Unlock()
+			if err != nil {
+				errCount.Add(1)
+				relog.Error("can't format stale actions: %v %v", zkActionPath, err)
+				return
 			}
 			if *purge && len(staleActions) > 0 {
-				err := zkts.PurgeActions(zkActionPath, tm.ActionNodeCanBePurged)
+				if *dryRun {
+					// Preview the same path-walk zkts.PurgeActions below
+					// would do, not just the stale subset: PurgeActions
+					// deletes every terminal action under zkActionPath
+					// regardless of staleness, so a preview built from
+					// the stale slice could under-report what's actually
+					// going to be deleted.
+					stdout.Lock()
+					_, err := previewPurge(ctx, zkts.GetZConn(), zkActionPath)
+					stdout.Unlock()
+					if err != nil {
+						errCount.Add(1)
+						relog.Error("can't preview purge: %v %v", zkActionPath, err)
+					}
+					return
+				}
+				err := zkts.PurgeActions(ctx, zkActionPath, tm.ActionNodeCanBePurged, *force)
 				if err != nil {
 					errCount.Add(1)
 					relog.Error("can't purge stale actions: %v %v", zkActionPath, err)
@@ -167,6 +306,10 @@ func commandStaleActions(wrangler *wr.Wrangler, subFlags *flag.FlagSet, args []s
 
 func commandPruneActionLogs(wrangler *wr.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
 	keepCount := subFlags.Int("keep-count", 10, "count to keep")
+	force := subFlags.Bool("force", false, "skip the version check and delete unconditionally, even if an entry was updated since it was listed")
+	dryRun := subFlags.Bool("dry-run", false, "print what would be pruned, per path, without deleting anything")
+	timeout := subFlags.Duration("timeout", 0, "abort remaining work if it isn't done within this long (0 = no timeout)")
+	maxConcurrency := subFlags.Int("max-concurrency", defaultMaxConcurrency, "maximum number of actionlog paths to prune concurrently")
 	subFlags.Parse(args)
 
 	if subFlags.NArg() == 0 {
@@ -183,13 +326,34 @@ func commandPruneActionLogs(wrangler *wr.Wrangler, subFlags *flag.FlagSet, args
 		return "", fmt.Errorf("PruneActionLogs requires a ZkTopologyServer")
 	}
 
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	sem := make(chan struct{}, *maxConcurrency)
 	var errCount sync2.AtomicInt32
 	wg := sync.WaitGroup{}
 	for _, zkActionLogPath := range paths {
 		wg.Add(1)
 		go func(zkActionLogPath string) {
 			defer wg.Done()
-			purgedCount, err := zkts.PruneActionLogs(zkActionLogPath, *keepCount)
+			if err := acquire(ctx, sem); err != nil {
+				errCount.Add(1)
+				relog.Error("%v pruning failed: %v", zkActionLogPath, err)
+				return
+			}
+			defer func() { <-sem }()
+			if *dryRun {
+				if _, err := previewPrune(ctx, zkts.GetZConn(), zkActionLogPath, *keepCount); err != nil {
+					errCount.Add(1)
+					relog.Error("can't preview prune: %v %v", zkActionLogPath, err)
+				}
+				return
+			}
+			purgedCount, err := zkts.PruneActionLogs(ctx, zkActionLogPath, *keepCount, *force)
 			if err == nil {
 				relog.Debug("%v pruned %v", zkActionLogPath, purgedCount)
 			} else {
@@ -205,6 +369,33 @@ func commandPruneActionLogs(wrangler *wr.Wrangler, subFlags *flag.FlagSet, args
 	return "", nil
 }
 
+func commandExportActionMetrics(wrangler *wr.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	addr := subFlags.String("addr", "", "if set, serve Prometheus metrics on this address forever instead of dumping once")
+	staleThreshold := subFlags.Duration("stale-threshold", 5*time.Minute, "how long since an action was dispatched (or created, if not yet dispatched) before it is considered stale")
+	maxConcurrency := subFlags.Int("max-concurrency", 8, "maximum number of shards to scan concurrently")
+	subFlags.Parse(args)
+	if subFlags.NArg() == 0 {
+		relog.Fatal("action ExportActionMetrics requires <keyspace/shard> ...")
+	}
+	zkts, ok := wrangler.TopologyServer().(*zktopo.ZkTopologyServer)
+	if !ok {
+		return "", fmt.Errorf("ExportActionMetrics requires a ZkTopologyServer")
+	}
+
+	shards := make([]actionmetrics.KeyspaceShard, subFlags.NArg())
+	for i := 0; i < subFlags.NArg(); i++ {
+		keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(i))
+		shards[i] = actionmetrics.KeyspaceShard{Keyspace: keyspace, Shard: shard}
+	}
+
+	collector := actionmetrics.NewCollector(zkts, shards, *staleThreshold, *maxConcurrency)
+	if *addr != "" {
+		relog.Info("ExportActionMetrics: serving /metrics on %v", *addr)
+		return "", actionmetrics.Serve(collector, *addr)
+	}
+	return "", actionmetrics.DumpOnce(collector, os.Stdout)
+}
+
 func commandExportZkns(wrangler *wr.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
 	subFlags.Parse(args)
 	if subFlags.NArg() != 1 {
@@ -223,8 +414,12 @@ func commandExportZknsForKeyspace(wrangler *wr.Wrangler, subFlags *flag.FlagSet,
 	return "", wrangler.ExportZknsForKeyspace(keyspace)
 }
 
-func getActions(zconn zk.Conn, actionPath string) ([]*tm.ActionNode, error) {
+func getActions(ctx context.Context, zconn zk.Conn, actionPath string, sem chan struct{}) ([]*tm.ActionNode, error) {
+	if err := acquire(ctx, sem); err != nil {
+		return nil, err
+	}
 	actions, _, err := zconn.Children(actionPath)
+	<-sem
 	if err != nil {
 		return nil, fmt.Errorf("getActions failed: %v %v", actionPath, err)
 	}
@@ -236,6 +431,11 @@ func getActions(zconn zk.Conn, actionPath string) ([]*tm.ActionNode, error) {
 		wg.Add(1)
 		go func(action string) {
 			defer wg.Done()
+			if err := acquire(ctx, sem); err != nil {
+				relog.Warning("getActions: %v %v", actionPath, err)
+				return
+			}
+			defer func() { <-sem }()
 			actionNodePath := path.Join(actionPath, action)
 			data, _, err := zconn.Get(actionNodePath)
 			if err != nil && !zookeeper.IsError(err, zookeeper.ZNONODE) {
@@ -257,31 +457,31 @@ func getActions(zconn zk.Conn, actionPath string) ([]*tm.ActionNode, error) {
 	return nodes, nil
 }
 
-func listActionsByShard(ts naming.TopologyServer, keyspace, shard string) error {
+func listActionsByShard(ctx context.Context, ts naming.TopologyServer, keyspace, shard string, sem chan struct{}, format string) error {
 	// only works with ZkTopologyServer
 	zkts, ok := ts.(*zktopo.ZkTopologyServer)
 	if !ok {
 		return fmt.Errorf("listActionsByShard only works with ZkTopologyServer")
 	}
 
-	// print the shard action nodes
+	// gather the shard action nodes
 	shardActionPath := zkts.ShardActionPath(keyspace, shard)
-	shardActionNodes, err := getActions(zkts.GetZConn(), shardActionPath)
+	shardActionNodes, err := getActions(ctx, zkts.GetZConn(), shardActionPath, sem)
 	if err != nil {
 		return err
 	}
-	for _, shardAction := range shardActionNodes {
-		fmt.Println(fmtAction(shardAction))
+	if err := actionfmt.FormatActions(os.Stdout, shardActionNodes, format); err != nil {
+		return err
 	}
 
-	// get and print the tablet action nodes
+	// gather the tablet action nodes
 	wg := sync.WaitGroup{}
 	mu := sync.Mutex{}
 	actionMap := make(map[string]*tm.ActionNode)
 
 	f := func(actionPath string) {
 		defer wg.Done()
-		actionNodes, err := getActions(zkts.GetZConn(), actionPath)
+		actionNodes, err := getActions(ctx, zkts.GetZConn(), actionPath, sem)
 		if err != nil {
 			relog.Warning("listActionsByShard %v", err)
 			return
@@ -313,22 +513,33 @@ func listActionsByShard(ts naming.TopologyServer, keyspace, shard string) error
 
 	keys := wr.CopyMapKeys(actionMap, []string{}).([]string)
 	sort.Strings(keys)
+	actions := make([]*tm.ActionNode, 0, len(keys))
 	for _, key := range keys {
-		action := actionMap[key]
-		if action == nil {
+		if action := actionMap[key]; action == nil {
 			relog.Warning("nil action: %v", key)
 		} else {
-			fmt.Println(fmtAction(action))
+			actions = append(actions, action)
 		}
 	}
-	return nil
+	return actionfmt.FormatActions(os.Stdout, actions, format)
 }
 
 func commandListShardActions(wrangler *wr.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	timeout := subFlags.Duration("timeout", 0, "abort remaining work if it isn't done within this long (0 = no timeout)")
+	maxConcurrency := subFlags.Int("max-concurrency", defaultMaxConcurrency, "maximum number of concurrent ZK reads")
+	format := subFlags.String("format", actionfmt.Text, "output format: text or json")
 	subFlags.Parse(args)
 	if subFlags.NArg() != 1 {
 		relog.Fatal("action ListShardActions requires <keyspace/shard|zk shard path>")
 	}
 	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
-	return "", listActionsByShard(wrangler.TopologyServer(), keyspace, shard)
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	sem := make(chan struct{}, *maxConcurrency)
+	return "", listActionsByShard(ctx, wrangler.TopologyServer(), keyspace, shard, sem, *format)
 }
\ No newline at end of file
@@ -0,0 +1,74 @@
+// Copyright 2013, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package actionfmt renders tabletmanager.ActionNode action queue entries
+// for humans (text, one action per line) or for machines (NDJSON), so
+// dashboards and alerting can consume action-queue state without
+// screen-scraping vtctl output.
+package actionfmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	tm "code.google.com/p/vitess/go/vt/tabletmanager"
+)
+
+// Text is the plain, human-readable output format (the default).
+const Text = "text"
+
+// JSON emits one JSON object per action, newline-delimited (NDJSON).
+const JSON = "json"
+
+// action is the stable JSON schema emitted for each ActionNode.
+type action struct {
+	Path       string      `json:"path"`
+	Action     string      `json:"action"`
+	Args       interface{} `json:"args,omitempty"`
+	State      string      `json:"state"`
+	ActionGuid string      `json:"actionGuid"`
+	Dispatched int64       `json:"dispatched"`
+}
+
+// FormatActions writes nodes to w according to format ("text" or "json").
+// An unrecognized format is an error rather than a silent fallback, so
+// callers (and scripts) notice a typo instead of getting text when they
+// asked for json.
+func FormatActions(w io.Writer, nodes []*tm.ActionNode, format string) error {
+	switch format {
+	case "", Text:
+		for _, node := range nodes {
+			if _, err := fmt.Fprintln(w, formatText(node)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case JSON:
+		enc := json.NewEncoder(w)
+		for _, node := range nodes {
+			if err := enc.Encode(toJson(node)); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("actionfmt: unknown format %q, want %q or %q", format, Text, JSON)
+	}
+}
+
+func formatText(node *tm.ActionNode) string {
+	return fmt.Sprintf("%v %v %v %v %v", node.Path(), node.Action, node.State, node.ActionGuid, node.Dispatched)
+}
+
+func toJson(node *tm.ActionNode) *action {
+	return &action{
+		Path:       node.Path(),
+		Action:     node.Action,
+		Args:       node.Args,
+		State:      node.State,
+		ActionGuid: node.ActionGuid,
+		Dispatched: node.Dispatched.Unix(),
+	}
+}
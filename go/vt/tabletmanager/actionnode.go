@@ -0,0 +1,71 @@
+// Copyright 2013, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tabletmanager
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Action states. An ActionNode moves queued -> running -> (done | failed)
+// and is archived from the action path to the actionlog path once it
+// reaches a terminal state.
+const (
+	ActionStateQueued  = "queued"
+	ActionStateRunning = "running"
+	ActionStateDone    = "done"
+	ActionStateFailed  = "failed"
+)
+
+// ActionNode is the JSON payload stored at each action / actionlog znode.
+type ActionNode struct {
+	Action     string
+	ActionGuid string
+	Args       map[string]string
+	State      string
+	Created    time.Time
+	Dispatched time.Time
+	// Finished is the zero Time until the action reaches a terminal state.
+	Finished time.Time
+
+	path string
+}
+
+// Path returns the znode path this ActionNode was read from.
+func (n *ActionNode) Path() string {
+	return n.path
+}
+
+// ActionNodeFromJson decodes the action znode data found at path.
+func ActionNodeFromJson(data, nodePath string) (*ActionNode, error) {
+	node := &ActionNode{}
+	if err := json.Unmarshal([]byte(data), node); err != nil {
+		return nil, err
+	}
+	node.path = nodePath
+	return node, nil
+}
+
+// PurgePredicate decides whether an action is safe to delete outright.
+type PurgePredicate func(*ActionNode) bool
+
+// StalePredicate decides whether an action has been pending too long.
+type StalePredicate func(*ActionNode, time.Duration) bool
+
+// ActionNodeCanBePurged reports whether node has reached a terminal state
+// and can be deleted without losing in-flight work.
+func ActionNodeCanBePurged(node *ActionNode) bool {
+	return node.State == ActionStateDone || node.State == ActionStateFailed
+}
+
+// ActionNodeIsStale reports whether node was dispatched more than
+// maxStaleness ago. A node with no Dispatched timestamp hasn't
+// been picked up at all and isn't considered stale by this check.
+func ActionNodeIsStale(node *ActionNode, maxStaleness time.Duration) bool {
+	if node.Dispatched.IsZero() {
+		return false
+	}
+	return time.Since(node.Dispatched) > maxStaleness
+}
@@ -0,0 +1,171 @@
+// Copyright 2013, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zktopo
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+
+	"time"
+
+	"code.google.com/p/vitess/go/relog"
+	tm "code.google.com/p/vitess/go/vt/tabletmanager"
+	"code.google.com/p/vitess/go/zk"
+	"golang.org/x/net/context"
+	"launchpad.net/gozk/zookeeper"
+)
+
+// ErrBadVersion is returned (and logged, not propagated as a hard failure)
+// when a znode changed between being listed and being deleted, mirroring
+// how UpdateEndPoints treats a racing writer: skip that node, don't abort
+// the whole operation.
+var ErrBadVersion = errors.New("zktopo: znode changed since it was listed (bad version)")
+
+// deleteVersioned deletes nodePath only if its ZK stat version is still
+// version, the one the caller observed when it read the node, so a write
+// that raced with the caller's read aborts the delete instead of silently
+// destroying it. A negative version makes it read the current version with
+// a fresh Get first, for callers that only listed the node's name; that
+// only catches writes between the Get and the delete. force bypasses the
+// check (version=-1, ZooKeeper's "don't care" version) for the historical
+// unconditional-delete behavior.
+func deleteVersioned(ctx context.Context, zconn zk.Conn, nodePath string, version int, force bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if force {
+		version = -1
+	} else if version < 0 {
+		_, stat, err := zconn.Get(nodePath)
+		if err != nil {
+			if zookeeper.IsError(err, zookeeper.ZNONODE) {
+				return nil
+			}
+			return err
+		}
+		version = stat.Version()
+	}
+	err := zconn.Delete(nodePath, version)
+	if err != nil && zookeeper.IsError(err, zookeeper.ZBADVERSION) {
+		relog.Warning("zktopo: %v changed since it was listed, skipping delete", nodePath)
+		return ErrBadVersion
+	}
+	return err
+}
+
+// PurgeActions deletes every action under actionPath for which pred
+// returns true. Each delete is version-checked against the znode's state
+// at the time it was read, unless force is set.
+func (zkts *ZkTopologyServer) PurgeActions(ctx context.Context, actionPath string, pred tm.PurgePredicate, force bool) error {
+	children, _, err := zkts.zconn.Children(actionPath)
+	if err != nil {
+		if zookeeper.IsError(err, zookeeper.ZNONODE) {
+			return nil
+		}
+		return fmt.Errorf("PurgeActions: listing %v: %v", actionPath, err)
+	}
+
+	for _, child := range children {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		nodePath := path.Join(actionPath, child)
+		data, stat, err := zkts.zconn.Get(nodePath)
+		if err != nil {
+			if zookeeper.IsError(err, zookeeper.ZNONODE) {
+				continue
+			}
+			relog.Warning("PurgeActions: reading %v: %v", nodePath, err)
+			continue
+		}
+		node, err := tm.ActionNodeFromJson(data, nodePath)
+		if err != nil {
+			relog.Warning("PurgeActions: parsing %v: %v", nodePath, err)
+			continue
+		}
+		if !pred(node) {
+			continue
+		}
+		if err := deleteVersioned(ctx, zkts.zconn, nodePath, stat.Version(), force); err != nil && err != ErrBadVersion {
+			relog.Warning("PurgeActions: deleting %v: %v", nodePath, err)
+		}
+	}
+	return nil
+}
+
+// StaleActions returns every action under actionPath for which
+// pred(node, maxStaleness) is true, with ActionNode.Path() populated from
+// the znode it was read from.
+func (zkts *ZkTopologyServer) StaleActions(ctx context.Context, actionPath string, maxStaleness time.Duration, pred tm.StalePredicate) ([]*tm.ActionNode, error) {
+	children, _, err := zkts.zconn.Children(actionPath)
+	if err != nil {
+		if zookeeper.IsError(err, zookeeper.ZNONODE) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("StaleActions: listing %v: %v", actionPath, err)
+	}
+
+	var stale []*tm.ActionNode
+	for _, child := range children {
+		if err := ctx.Err(); err != nil {
+			return stale, err
+		}
+		nodePath := path.Join(actionPath, child)
+		data, _, err := zkts.zconn.Get(nodePath)
+		if err != nil {
+			if zookeeper.IsError(err, zookeeper.ZNONODE) {
+				continue
+			}
+			relog.Warning("StaleActions: reading %v: %v", nodePath, err)
+			continue
+		}
+		node, err := tm.ActionNodeFromJson(data, nodePath)
+		if err != nil {
+			relog.Warning("StaleActions: parsing %v: %v", nodePath, err)
+			continue
+		}
+		if pred(node, maxStaleness) {
+			stale = append(stale, node)
+		}
+	}
+	return stale, nil
+}
+
+// PruneActionLogs deletes the oldest entries under actionLogPath until at
+// most keepCount remain, returning how many were actually removed. Deletes
+// are version-checked unless force is set.
+func (zkts *ZkTopologyServer) PruneActionLogs(ctx context.Context, actionLogPath string, keepCount int, force bool) (int, error) {
+	children, _, err := zkts.zconn.Children(actionLogPath)
+	if err != nil {
+		if zookeeper.IsError(err, zookeeper.ZNONODE) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("PruneActionLogs: listing %v: %v", actionLogPath, err)
+	}
+	sort.Strings(children)
+	if len(children) <= keepCount {
+		return 0, nil
+	}
+	toPrune := children[:len(children)-keepCount]
+
+	pruned := 0
+	for _, child := range toPrune {
+		if err := ctx.Err(); err != nil {
+			return pruned, err
+		}
+		nodePath := path.Join(actionLogPath, child)
+		if err := deleteVersioned(ctx, zkts.zconn, nodePath, -1, force); err != nil {
+			if err == ErrBadVersion {
+				continue
+			}
+			relog.Warning("PruneActionLogs: deleting %v: %v", nodePath, err)
+			continue
+		}
+		pruned++
+	}
+	return pruned, nil
+}
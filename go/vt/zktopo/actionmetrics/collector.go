@@ -0,0 +1,280 @@
+// Copyright 2013, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package actionmetrics exposes Prometheus metrics describing the health
+// of the ZK action queue (the action and actionlog nodes maintained by
+// zktopo.ZkTopologyServer) for a given set of shards.
+package actionmetrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/vt/naming"
+	tm "code.google.com/p/vitess/go/vt/tabletmanager"
+	"code.google.com/p/vitess/go/vt/zktopo"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"launchpad.net/gozk/zookeeper"
+)
+
+// KeyspaceShard identifies a single shard to be walked for action metrics.
+type KeyspaceShard struct {
+	Keyspace string
+	Shard    string
+}
+
+// Collector implements prometheus.Collector, walking the action and
+// actionlog paths for a fixed set of shards every time it is scraped.
+type Collector struct {
+	zkts           *zktopo.ZkTopologyServer
+	shards         []KeyspaceShard
+	staleThreshold time.Duration
+	maxConcurrency int
+
+	pendingCount  *prometheus.GaugeVec
+	oldestPending *prometheus.GaugeVec
+	staleCount    *prometheus.GaugeVec
+	actionLogLen  *prometheus.GaugeVec
+	actionLatency *prometheus.HistogramVec
+
+	// observedMu guards observed, the set of actionlog entries (by znode
+	// path) already fed into actionLatency. actionLatency is cumulative
+	// and never reset, so each terminal action must be observed exactly
+	// once across the Collector's lifetime, not once per scrape.
+	observedMu sync.Mutex
+	observed   map[string]bool
+}
+
+// NewCollector returns a Collector that will walk the action queues of
+// shards on every Collect(), using up to maxConcurrency concurrent ZK
+// reads. An action is considered stale once it has been pending longer
+// than staleThreshold.
+func NewCollector(zkts *zktopo.ZkTopologyServer, shards []KeyspaceShard, staleThreshold time.Duration, maxConcurrency int) *Collector {
+	labels := []string{"keyspace", "shard"}
+	return &Collector{
+		zkts:           zkts,
+		shards:         shards,
+		staleThreshold: staleThreshold,
+		maxConcurrency: maxConcurrency,
+		observed:       make(map[string]bool),
+
+		pendingCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "vitess",
+			Subsystem: "action_queue",
+			Name:      "pending_actions",
+			Help:      "Number of actions currently queued for a shard.",
+		}, labels),
+		oldestPending: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "vitess",
+			Subsystem: "action_queue",
+			Name:      "oldest_pending_action_age_seconds",
+			Help:      "Age in seconds of the oldest queued action for a shard.",
+		}, labels),
+		staleCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "vitess",
+			Subsystem: "action_queue",
+			Name:      "stale_actions",
+			Help:      "Number of queued actions older than the stale threshold.",
+		}, labels),
+		actionLogLen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "vitess",
+			Subsystem: "action_queue",
+			Name:      "actionlog_length",
+			Help:      "Number of entries in the actionlog for a shard.",
+		}, labels),
+		actionLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "vitess",
+			Subsystem: "action_queue",
+			Name:      "action_latency_seconds",
+			Help:      "Time between an action being dispatched and finishing, by action type.",
+			// Action latencies run from seconds to tens of minutes, not
+			// the client's default (<=10s) buckets, which would collapse
+			// almost every observation into the +Inf bucket.
+			Buckets: []float64{1, 5, 15, 30, 60, 300, 600, 1800, 3600},
+		}, []string{"action"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.pendingCount.Describe(ch)
+	c.oldestPending.Describe(ch)
+	c.staleCount.Describe(ch)
+	c.actionLogLen.Describe(ch)
+	c.actionLatency.Describe(ch)
+}
+
+// Collect implements prometheus.Collector, walking every configured shard
+// concurrently with up to maxConcurrency outstanding ZK reads.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	sem := make(chan struct{}, c.maxConcurrency)
+	wg := sync.WaitGroup{}
+	for _, ks := range c.shards {
+		wg.Add(1)
+		go func(ks KeyspaceShard) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := c.collectShard(ks); err != nil {
+				relog.Warning("actionmetrics: %v/%v: %v", ks.Keyspace, ks.Shard, err)
+			}
+		}(ks)
+	}
+	wg.Wait()
+
+	c.pendingCount.Collect(ch)
+	c.oldestPending.Collect(ch)
+	c.staleCount.Collect(ch)
+	c.actionLogLen.Collect(ch)
+	c.actionLatency.Collect(ch)
+}
+
+func (c *Collector) collectShard(ks KeyspaceShard) error {
+	zconn := c.zkts.GetZConn()
+
+	actionPaths := []string{c.zkts.ShardActionPath(ks.Keyspace, ks.Shard)}
+	tabletAliases, err := naming.FindAllTabletAliasesInShard(c.zkts, ks.Keyspace, ks.Shard)
+	if err != nil {
+		return fmt.Errorf("finding tablets: %v", err)
+	}
+	for _, alias := range tabletAliases {
+		actionPaths = append(actionPaths, zktopo.TabletActionPathForAlias(alias))
+	}
+
+	var pending, stale int
+	var oldest time.Duration
+	now := time.Now()
+	for _, actionPath := range actionPaths {
+		actions, _, err := zconn.Children(actionPath)
+		if err != nil {
+			if zookeeper.IsError(err, zookeeper.ZNONODE) {
+				continue
+			}
+			return fmt.Errorf("listing %v: %v", actionPath, err)
+		}
+		pending += len(actions)
+		for _, action := range actions {
+			data, _, err := zconn.Get(actionPath + "/" + action)
+			if err != nil {
+				relog.Warning("actionmetrics: reading %v/%v: %v", actionPath, action, err)
+				continue
+			}
+			node, err := tm.ActionNodeFromJson(data, actionPath+"/"+action)
+			if err != nil {
+				relog.Warning("actionmetrics: parsing %v/%v: %v", actionPath, action, err)
+				continue
+			}
+			// A node that hasn't been dispatched yet is exactly the stuck
+			// action operators want to see: fall back to Created so it
+			// still counts towards oldest/stale instead of being skipped.
+			since := node.Dispatched
+			if since.IsZero() {
+				since = node.Created
+			}
+			if since.IsZero() {
+				continue
+			}
+			age := now.Sub(since)
+			if age > oldest {
+				oldest = age
+			}
+			if age > c.staleThreshold {
+				stale++
+			}
+		}
+	}
+
+	logLen, err := c.recordActionLogLatencies(ks)
+	if err != nil {
+		return err
+	}
+
+	labels := prometheus.Labels{"keyspace": ks.Keyspace, "shard": ks.Shard}
+	c.pendingCount.With(labels).Set(float64(pending))
+	c.oldestPending.With(labels).Set(oldest.Seconds())
+	c.staleCount.With(labels).Set(float64(stale))
+	c.actionLogLen.With(labels).Set(float64(logLen))
+	return nil
+}
+
+// recordActionLogLatencies returns the number of entries in the shard's
+// actionlog, and observes actionLatency once for each terminal entry it
+// hasn't already seen. actionlog entries are archived exactly once (they
+// never change after being written), so tracking observed znode paths on
+// the Collector is enough to keep the cumulative histogram from
+// double-counting the same completed action across scrapes.
+func (c *Collector) recordActionLogLatencies(ks KeyspaceShard) (int, error) {
+	actionLogPath := c.zkts.ShardActionLogPath(ks.Keyspace, ks.Shard)
+	zconn := c.zkts.GetZConn()
+	entries, _, err := zconn.Children(actionLogPath)
+	if err != nil {
+		if zookeeper.IsError(err, zookeeper.ZNONODE) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("listing %v: %v", actionLogPath, err)
+	}
+
+	for _, entry := range entries {
+		entryPath := actionLogPath + "/" + entry
+		c.observedMu.Lock()
+		seen := c.observed[entryPath]
+		c.observedMu.Unlock()
+		if seen {
+			continue
+		}
+
+		data, _, err := zconn.Get(entryPath)
+		if err != nil {
+			relog.Warning("actionmetrics: reading %v: %v", entryPath, err)
+			continue
+		}
+		node, err := tm.ActionNodeFromJson(data, entryPath)
+		if err != nil {
+			relog.Warning("actionmetrics: parsing %v: %v", entryPath, err)
+			continue
+		}
+		if node.Dispatched.IsZero() || node.Finished.IsZero() {
+			continue
+		}
+		c.actionLatency.WithLabelValues(node.Action).Observe(node.Finished.Sub(node.Dispatched).Seconds())
+
+		c.observedMu.Lock()
+		c.observed[entryPath] = true
+		c.observedMu.Unlock()
+	}
+	return len(entries), nil
+}
+
+// Serve registers the collector and blocks serving /metrics on addr.
+func Serve(c *Collector, addr string) error {
+	prometheus.MustRegister(c)
+	http.Handle("/metrics", prometheus.Handler())
+	return http.ListenAndServe(addr, nil)
+}
+
+// DumpOnce registers the collector, gathers it a single time and writes
+// the result to w in the Prometheus text exposition format. It's meant
+// for one-shot invocations from cron rather than long-lived scraping.
+func DumpOnce(c *Collector, w io.Writer) error {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		return err
+	}
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	for _, mf := range metricFamilies {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
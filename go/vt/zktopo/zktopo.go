@@ -0,0 +1,48 @@
+// Copyright 2013, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package zktopo is a Zookeeper-backed implementation of
+// naming.TopologyServer.
+package zktopo
+
+import (
+	"fmt"
+
+	"code.google.com/p/vitess/go/vt/naming"
+	"code.google.com/p/vitess/go/zk"
+)
+
+// ZkTopologyServer is the Zookeeper implementation of naming.TopologyServer.
+type ZkTopologyServer struct {
+	zconn zk.Conn
+}
+
+// NewZkTopologyServer wraps an already-connected zk.Conn.
+func NewZkTopologyServer(zconn zk.Conn) *ZkTopologyServer {
+	return &ZkTopologyServer{zconn: zconn}
+}
+
+// GetZConn returns the underlying ZK connection, for callers (like vtctl)
+// that need to issue raw ZK calls alongside the higher-level methods here.
+func (zkts *ZkTopologyServer) GetZConn() zk.Conn {
+	return zkts.zconn
+}
+
+// ShardActionPath returns the znode under which actions are queued for a
+// shard, e.g. /zk/global/vt/keyspaces/<keyspace>/shards/<shard>/action.
+func (zkts *ZkTopologyServer) ShardActionPath(keyspace, shard string) string {
+	return fmt.Sprintf("/zk/global/vt/keyspaces/%v/shards/%v/action", keyspace, shard)
+}
+
+// ShardActionLogPath returns the znode actions are archived to once they
+// reach a terminal state, the sibling of ShardActionPath.
+func (zkts *ZkTopologyServer) ShardActionLogPath(keyspace, shard string) string {
+	return fmt.Sprintf("/zk/global/vt/keyspaces/%v/shards/%v/actionlog", keyspace, shard)
+}
+
+// TabletActionPathForAlias returns the znode under which actions are
+// queued for a single tablet.
+func TabletActionPathForAlias(alias naming.TabletAlias) string {
+	return fmt.Sprintf("/zk/%v/vt/tablets/%010d/action", alias.Cell, alias.Uid)
+}